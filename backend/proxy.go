@@ -6,42 +6,80 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
+	"math"
 	"net/http"
 	"strings"
 	"sync"
-	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/chengshiwen/influx-proxy/util"
 )
 
 type Proxy struct {
 	sync.RWMutex
-	Circles      []*Circle
-	DBSet        util.Set
-	CircleKeyMap map[int]string
+	Circles       []*Circle
+	CircleIds     []string
+	CircleWeights []float64
+	DBSet         util.Set
+	CircleKeyMap  map[string]int // memoizes AssignCircle, purely a cache: safe to clear or drop
+
+	// RPFile, when set, is where the last-known retention policy set is
+	// persisted so a restart can reconcile drifted backends.
+	RPFile            string
+	retentionPolicies map[string][]*RetentionPolicyInfo
 }
 
 func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
 	ip = &Proxy{
-		Circles:      make([]*Circle, len(cfg.Circles)),
-		DBSet:        util.NewSet(),
-		CircleKeyMap: make(map[int]string),
+		Circles:       make([]*Circle, len(cfg.Circles)),
+		CircleIds:     make([]string, len(cfg.Circles)),
+		CircleWeights: make([]float64, len(cfg.Circles)),
+		DBSet:         util.NewSet(),
+		CircleKeyMap:  make(map[string]int),
+		RPFile:        cfg.RPFile,
 	}
 	for idx, circfg := range cfg.Circles {
 		ip.Circles[idx] = NewCircle(circfg, cfg, idx)
-		ip.CircleKeyMap[idx] = ""
+		ip.CircleIds[idx] = fmt.Sprintf("circle-%d", idx)
+		ip.CircleWeights[idx] = circfg.Weight
+		if ip.CircleWeights[idx] <= 0 {
+			ip.CircleWeights[idx] = 1
+		}
 	}
 	for _, db := range cfg.DBList {
 		ip.DBSet.Add(db)
 	}
-	rand.Seed(time.Now().Unix())
+	if err := ip.loadRetentionPolicies(); err != nil {
+		log.Printf("load retention policies error: %s", err)
+	}
+	ip.reconcileRetentionPolicies()
 	return
 }
 
+// reconcileRetentionPolicies re-applies every persisted policy to every
+// backend, fixing any backend that drifted while the proxy was down.
+func (ip *Proxy) reconcileRetentionPolicies() {
+	ip.RLock()
+	policies := ip.retentionPolicies
+	ip.RUnlock()
+	for db, rpis := range policies {
+		for _, rpi := range rpis {
+			for _, r := range ip.rpFanout(db, rpi.createStatement(db)) {
+				if r.Err == "" {
+					continue
+				}
+				if err := ip.rpFanoutOne(db, r.Url, rpi.alterStatement(db)); err != nil {
+					log.Printf("reconcile retention policy %q on %q at %s error: %s", rpi.Name, db, r.Url, err)
+				}
+			}
+		}
+	}
+}
+
 func GetKey(db, meas string) string {
 	var b strings.Builder
 	b.Grow(len(db) + len(meas) + 1)
@@ -67,34 +105,56 @@ func (ip *Proxy) GetBackends(key string) []*Backend {
 	return backends
 }
 
+// AssignCircle deterministically places key on a circle via rendezvous hashing.
 func (ip *Proxy) AssignCircle(key string) *Circle {
+	ip.RLock()
+	if i, ok := ip.CircleKeyMap[key]; ok {
+		ip.RUnlock()
+		return ip.Circles[i]
+	}
+	ip.RUnlock()
+
+	i := ip.rendezvousIndex(key)
+
 	ip.Lock()
-	defer ip.Unlock()
+	ip.CircleKeyMap[key] = i
+	ip.Unlock()
+	return ip.Circles[i]
+}
 
-	for i, k := range ip.CircleKeyMap {
-		if k == key {
-			return ip.Circles[i]
-		}
-	}
-	for i, k := range ip.CircleKeyMap {
-		if k == "" {
-			ip.CircleKeyMap[i] = key
-			return ip.Circles[i]
+// rendezvousIndex returns the circle index with the lowest HRW score for key.
+func (ip *Proxy) rendezvousIndex(key string) int {
+	best := -1
+	var bestScore float64
+	for i, id := range ip.CircleIds {
+		h := xxhash.Sum64String(key + "|" + id)
+		score := -math.Log(float64(h)/float64(math.MaxUint64)) / ip.CircleWeights[i]
+		if best == -1 || score < bestScore {
+			best, bestScore = i, score
 		}
 	}
-	return ip.Circles[rand.Intn(len(ip.Circles))]
+	return best
 }
 
 func (ip *Proxy) GetCircle(key string) *Circle {
-	ip.RLock()
-	defer ip.RUnlock()
+	return ip.AssignCircle(key)
+}
 
-	for i, k := range ip.CircleKeyMap {
-		if k == key {
-			return ip.Circles[i]
-		}
+// AssignCircleId reports the CircleIds entry that key is assigned to.
+func (ip *Proxy) AssignCircleId(key string) string {
+	ip.RLock()
+	if i, ok := ip.CircleKeyMap[key]; ok {
+		ip.RUnlock()
+		return ip.CircleIds[i]
 	}
-	return nil
+	ip.RUnlock()
+
+	i := ip.rendezvousIndex(key)
+
+	ip.Lock()
+	ip.CircleKeyMap[key] = i
+	ip.Unlock()
+	return ip.CircleIds[i]
 }
 
 func (ip *Proxy) GetHealth(stats bool) []interface{} {
@@ -140,21 +200,37 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 
 	selectOrShow := CheckSelectOrShowFromTokens(tokens)
 	if selectOrShow && from {
-		return QueryFromQL(w, req, ip, tokens, db)
+		body, err = QueryFromQL(w, req, ip, tokens, db)
 	} else if selectOrShow && !from {
-		return QueryShowQL(w, req, ip, tokens)
+		body, err = QueryShowQL(w, req, ip, tokens)
 	} else if CheckDeleteOrDropMeasurementFromTokens(tokens) {
 		return QueryDeleteOrDropQL(w, req, ip, tokens, db)
 	} else if alterDb || CheckRetentionPolicyFromTokens(tokens) {
 		return QueryAlterQL(w, req, ip)
+	} else {
+		return nil, ErrIllegalQL
+	}
+	if err != nil || !selectOrShow {
+		return body, err
+	}
+
+	opts := ParseQueryOptions(req)
+	if !opts.Chunked && opts.Epoch == "" && !opts.Pretty {
+		return body, nil
 	}
-	return nil, ErrIllegalQL
+	if err := WriteQueryResponse(w, body, opts); err != nil {
+		return nil, err
+	}
+	return nil, nil
 }
 
-func (ip *Proxy) Write(p []byte, db, precision string) (err error) {
+func (ip *Proxy) Write(ctx context.Context, p []byte, db, precision string) (err error) {
 	buf := bytes.NewBuffer(p)
 	var line []byte
 	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		line, err = buf.ReadBytes('\n')
 		switch err {
 		default:
@@ -166,12 +242,12 @@ func (ip *Proxy) Write(p []byte, db, precision string) (err error) {
 		if len(line) == 0 {
 			break
 		}
-		ip.WriteRow(line, db, precision)
+		ip.WriteRow(ctx, line, db, precision)
 	}
 	return
 }
 
-func (ip *Proxy) WriteRow(line []byte, db, precision string) {
+func (ip *Proxy) WriteRow(ctx context.Context, line []byte, db, precision string) {
 	nanoLine := AppendNano(line, precision)
 	meas, err := ScanKey(nanoLine)
 	if err != nil {
@@ -192,7 +268,7 @@ func (ip *Proxy) WriteRow(line []byte, db, precision string) {
 
 	point := &LinePoint{db, nanoLine}
 	for _, be := range backends {
-		err := be.WritePoint(point)
+		err := be.WritePoint(ctx, point)
 		if err != nil {
 			log.Printf("write data to buffer error: %s, %s, %s, %s, %s", err, be.Url, db, precision, string(line))
 		}
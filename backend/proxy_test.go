@@ -0,0 +1,57 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRendezvousIndexDeterministic(t *testing.T) {
+	ip := &Proxy{
+		CircleIds:     []string{"circle-0", "circle-1", "circle-2"},
+		CircleWeights: []float64{1, 1, 1},
+	}
+	i := ip.rendezvousIndex("mydb,cpu")
+	for n := 0; n < 100; n++ {
+		if got := ip.rendezvousIndex("mydb,cpu"); got != i {
+			t.Fatalf("rendezvousIndex not deterministic: got %d, want %d", got, i)
+		}
+	}
+}
+
+func TestRendezvousIndexSpreadsKeys(t *testing.T) {
+	ip := &Proxy{
+		CircleIds:     []string{"circle-0", "circle-1", "circle-2"},
+		CircleWeights: []float64{1, 1, 1},
+	}
+	counts := make(map[int]int)
+	for n := 0; n < 3000; n++ {
+		key := GetKey("db", "meas"+strconv.Itoa(n))
+		counts[ip.rendezvousIndex(key)]++
+	}
+	for i := range ip.CircleIds {
+		if counts[i] == 0 {
+			t.Errorf("circle %d never won any key", i)
+		}
+	}
+}
+
+func TestRendezvousIndexHeavierWeightWinsMore(t *testing.T) {
+	ip := &Proxy{
+		CircleIds:     []string{"circle-0", "circle-1"},
+		CircleWeights: []float64{1, 100},
+	}
+	heavy := 0
+	for n := 0; n < 2000; n++ {
+		key := GetKey("db", "meas"+strconv.Itoa(n))
+		if ip.rendezvousIndex(key) == 1 {
+			heavy++
+		}
+	}
+	if heavy < 1000 {
+		t.Errorf("expected the heavier-weighted circle to win most keys, got %d/2000", heavy)
+	}
+}
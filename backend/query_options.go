@@ -0,0 +1,200 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultChunkSize = 10000
+
+// QueryOptions captures the presentation parameters InfluxDB accepts on
+// /query: response chunking, timestamp epoch and pretty printing.
+type QueryOptions struct {
+	Chunked   bool
+	ChunkSize int
+	Epoch     string
+	Pretty    bool
+}
+
+// ParseQueryOptions reads chunked, chunk_size, epoch and pretty from req.
+func ParseQueryOptions(req *http.Request) QueryOptions {
+	opts := QueryOptions{
+		Epoch:  req.FormValue("epoch"),
+		Pretty: req.FormValue("pretty") == "true",
+	}
+	if req.FormValue("chunked") == "true" {
+		opts.Chunked = true
+		opts.ChunkSize = defaultChunkSize
+		if n, err := strconv.Atoi(req.FormValue("chunk_size")); err == nil && n > 0 {
+			opts.ChunkSize = n
+		}
+	}
+	return opts
+}
+
+// queryResult is one statement's entry in queryResponse's results.
+type queryResult struct {
+	StatementID int                      `json:"statement_id"`
+	Series      []map[string]interface{} `json:"series,omitempty"`
+	Partial     bool                     `json:"partial,omitempty"`
+	Error       string                   `json:"error,omitempty"`
+}
+
+// queryResponse mirrors the JSON envelope InfluxDB returns from /query.
+type queryResponse struct {
+	Results []queryResult `json:"results"`
+}
+
+// WriteQueryResponse applies epoch conversion and pretty printing to body,
+// then writes it to w, chunking by opts.ChunkSize when opts.Chunked.
+func WriteQueryResponse(w http.ResponseWriter, body []byte, opts QueryOptions) error {
+	if opts.Epoch != "" {
+		var err error
+		body, err = convertEpoch(body, opts.Epoch)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !opts.Chunked {
+		w.Header().Set("Content-Type", "application/json")
+		if opts.Pretty {
+			body = prettyPrint(body)
+		}
+		_, err := w.Write(body)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	flusher, _ := w.(http.Flusher)
+	var resp queryResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return err
+	}
+	for _, result := range resp.Results {
+		for _, chunk := range chunkResult(result, opts.ChunkSize) {
+			b, err := json.Marshal(queryResponse{Results: []queryResult{chunk}})
+			if err != nil {
+				return err
+			}
+			if opts.Pretty {
+				b = prettyPrint(b)
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	return nil
+}
+
+// chunkResult splits result's series into pieces of at most chunkSize rows.
+func chunkResult(result queryResult, chunkSize int) []queryResult {
+	if chunkSize <= 0 || len(result.Series) == 0 {
+		return []queryResult{result}
+	}
+	var chunks []queryResult
+	for _, series := range result.Series {
+		values, _ := series["values"].([]interface{})
+		if len(values) == 0 {
+			chunks = append(chunks, queryResult{StatementID: result.StatementID, Series: []map[string]interface{}{series}})
+			continue
+		}
+		for start := 0; start < len(values); start += chunkSize {
+			end := start + chunkSize
+			if end > len(values) {
+				end = len(values)
+			}
+			part := cloneSeries(series)
+			part["values"] = values[start:end]
+			partial := end < len(values)
+			chunks = append(chunks, queryResult{
+				StatementID: result.StatementID,
+				Series:      []map[string]interface{}{part},
+				Partial:     partial,
+			})
+		}
+	}
+	return chunks
+}
+
+func cloneSeries(series map[string]interface{}) map[string]interface{} {
+	clone := make(map[string]interface{}, len(series))
+	for k, v := range series {
+		clone[k] = v
+	}
+	return clone
+}
+
+// convertEpoch rewrites a query response's "time" column to the given epoch.
+func convertEpoch(body []byte, epoch string) ([]byte, error) {
+	divisor, ok := epochDivisors[epoch]
+	if !ok {
+		return body, nil
+	}
+	var resp queryResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	for ri, result := range resp.Results {
+		for si, series := range result.Series {
+			columns, _ := series["columns"].([]interface{})
+			timeIdx := -1
+			for i, c := range columns {
+				if c == "time" {
+					timeIdx = i
+					break
+				}
+			}
+			if timeIdx < 0 {
+				continue
+			}
+			values, _ := series["values"].([]interface{})
+			for _, row := range values {
+				cols, ok := row.([]interface{})
+				if !ok || timeIdx >= len(cols) {
+					continue
+				}
+				switch t := cols[timeIdx].(type) {
+				case float64:
+					cols[timeIdx] = int64(t) / divisor
+				case string:
+					if parsed, err := time.Parse(time.RFC3339Nano, t); err == nil {
+						cols[timeIdx] = parsed.UnixNano() / divisor
+					}
+				}
+			}
+			resp.Results[ri].Series[si]["values"] = values
+		}
+	}
+	return json.Marshal(resp)
+}
+
+var epochDivisors = map[string]int64{
+	"ns": 1,
+	"u":  1e3,
+	"ms": 1e6,
+	"s":  1e9,
+	"m":  60 * 1e9,
+	"h":  3600 * 1e9,
+}
+
+// prettyPrint re-indents a JSON document.
+func prettyPrint(body []byte) []byte {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, body, "", "    "); err != nil {
+		return body
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+const testQueryBody = `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[["2021-01-01T00:00:00Z",1],["2021-01-01T00:00:01Z",2],["2021-01-01T00:00:02Z",3]]}]}]}`
+
+func TestConvertEpochRewritesRFC3339Time(t *testing.T) {
+	body, err := convertEpoch([]byte(testQueryBody), "s")
+	if err != nil {
+		t.Fatalf("convertEpoch error: %s", err)
+	}
+	var resp queryResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	values := resp.Results[0].Series[0]["values"].([]interface{})
+	row := values[0].([]interface{})
+	got := row[0].(float64)
+	if got != 1609459200 {
+		t.Errorf("converted time = %v, want 1609459200", got)
+	}
+}
+
+func TestConvertEpochUnknownEpochNoop(t *testing.T) {
+	body, err := convertEpoch([]byte(testQueryBody), "bogus")
+	if err != nil {
+		t.Fatalf("convertEpoch error: %s", err)
+	}
+	if string(body) != testQueryBody {
+		t.Errorf("expected unmodified body for unknown epoch")
+	}
+}
+
+func TestChunkResultSplitsByChunkSize(t *testing.T) {
+	var resp queryResponse
+	if err := json.Unmarshal([]byte(testQueryBody), &resp); err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	chunks := chunkResult(resp.Results[0], 2)
+	if len(chunks) != 2 {
+		t.Fatalf("got %d chunks, want 2", len(chunks))
+	}
+	first := chunks[0].Series[0]["values"].([]interface{})
+	if len(first) != 2 || !chunks[0].Partial {
+		t.Errorf("first chunk should have 2 rows and Partial=true, got %d rows, partial=%v", len(first), chunks[0].Partial)
+	}
+	last := chunks[1].Series[0]["values"].([]interface{})
+	if len(last) != 1 || chunks[1].Partial {
+		t.Errorf("last chunk should have 1 row and Partial=false, got %d rows, partial=%v", len(last), chunks[1].Partial)
+	}
+}
+
+func TestWriteQueryResponseChunked(t *testing.T) {
+	w := httptest.NewRecorder()
+	opts := QueryOptions{Chunked: true, ChunkSize: 2}
+	if err := WriteQueryResponse(w, []byte(testQueryBody), opts); err != nil {
+		t.Fatalf("WriteQueryResponse error: %s", err)
+	}
+	decoder := json.NewDecoder(w.Body)
+	count := 0
+	for decoder.More() {
+		var resp queryResponse
+		if err := decoder.Decode(&resp); err != nil {
+			t.Fatalf("decode chunk %d error: %s", count, err)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("got %d chunk objects written, want 2", count)
+	}
+}
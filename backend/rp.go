@@ -0,0 +1,317 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionPolicyInfo describes a retention policy the proxy manages
+// cluster-wide.
+type RetentionPolicyInfo struct {
+	Name               string
+	Duration           time.Duration
+	ShardGroupDuration time.Duration
+	ReplicaN           int
+	Default            bool
+}
+
+// rpiFields has RetentionPolicyInfo's fields but not its methods, so gob
+// encodes it field by field instead of calling back into MarshalBinary.
+type rpiFields RetentionPolicyInfo
+
+// MarshalBinary encodes the policy with gob so it can be persisted to disk.
+func (rpi *RetentionPolicyInfo) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode((*rpiFields)(rpi)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a policy previously encoded with MarshalBinary.
+func (rpi *RetentionPolicyInfo) UnmarshalBinary(data []byte) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode((*rpiFields)(rpi))
+}
+
+// createStatement returns the CREATE RETENTION POLICY statement for rpi.
+func (rpi *RetentionPolicyInfo) createStatement(db string) string {
+	stmt := fmt.Sprintf("CREATE RETENTION POLICY %s ON %q DURATION %s REPLICATION %d",
+		quoteIdent(rpi.Name), db, formatDuration(rpi.Duration), rpi.ReplicaN)
+	if rpi.ShardGroupDuration > 0 {
+		stmt += " SHARD DURATION " + formatDuration(rpi.ShardGroupDuration)
+	}
+	if rpi.Default {
+		stmt += " DEFAULT"
+	}
+	return stmt
+}
+
+// alterStatement returns the ALTER RETENTION POLICY statement for rpi.
+func (rpi *RetentionPolicyInfo) alterStatement(db string) string {
+	stmt := fmt.Sprintf("ALTER RETENTION POLICY %s ON %q DURATION %s REPLICATION %d",
+		quoteIdent(rpi.Name), db, formatDuration(rpi.Duration), rpi.ReplicaN)
+	if rpi.ShardGroupDuration > 0 {
+		stmt += " SHARD DURATION " + formatDuration(rpi.ShardGroupDuration)
+	}
+	if rpi.Default {
+		stmt += " DEFAULT"
+	}
+	return stmt
+}
+
+// dropStatement returns the DROP RETENTION POLICY statement for name.
+func dropStatement(name, db string) string {
+	return fmt.Sprintf("DROP RETENTION POLICY %s ON %q", quoteIdent(name), db)
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `\"`) + `"`
+}
+
+func formatDuration(d time.Duration) string {
+	if d <= 0 {
+		return "INF"
+	}
+	return d.String()
+}
+
+// BackendResult is one backend's outcome from a cluster-wide RP fan-out.
+type BackendResult struct {
+	Url string
+	Err string
+}
+
+// allBackends flattens every backend across every circle.
+func (ip *Proxy) allBackends() []*Backend {
+	var backends []*Backend
+	for _, c := range ip.Circles {
+		backends = append(backends, c.Backends...)
+	}
+	return backends
+}
+
+// rpFanoutOne runs stmt against the single backend whose Url is url.
+func (ip *Proxy) rpFanoutOne(db, url, stmt string) error {
+	for _, be := range ip.allBackends() {
+		if be.Url == url {
+			_, err := be.QueryIQL(db, stmt)
+			return err
+		}
+	}
+	return fmt.Errorf("backend %s not found", url)
+}
+
+// rpFanout runs stmt against every backend of every circle in parallel.
+func (ip *Proxy) rpFanout(db, stmt string) []BackendResult {
+	backends := ip.allBackends()
+	results := make([]BackendResult, len(backends))
+	var wg sync.WaitGroup
+	for i, be := range backends {
+		wg.Add(1)
+		go func(i int, be *Backend) {
+			defer wg.Done()
+			_, err := be.QueryIQL(db, stmt)
+			r := BackendResult{Url: be.Url}
+			if err != nil {
+				r.Err = err.Error()
+			}
+			results[i] = r
+		}(i, be)
+	}
+	wg.Wait()
+	return results
+}
+
+// failures returns the backends in results that errored.
+func failures(results []BackendResult) []BackendResult {
+	var failed []BackendResult
+	for _, r := range results {
+		if r.Err != "" {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// CreateRetentionPolicy fans CREATE RETENTION POLICY out to every backend.
+// On partial failure it rolls back by dropping the policy from the backends
+// that succeeded.
+func (ip *Proxy) CreateRetentionPolicy(db string, rpi *RetentionPolicyInfo) ([]BackendResult, error) {
+	results := ip.rpFanout(db, rpi.createStatement(db))
+	if failed := failures(results); len(failed) > 0 {
+		ip.rollbackCreate(db, rpi, results)
+		return results, fmt.Errorf("create retention policy failed on %d backend(s)", len(failed))
+	}
+	ip.saveRetentionPolicy(db, rpi)
+	return results, nil
+}
+
+// AlterRetentionPolicy fans ALTER RETENTION POLICY out to every backend.
+// On partial failure it rolls back by re-applying the previous persisted
+// policy to the backends that succeeded; when no policy named rpi.Name is
+// persisted for db, nothing is rolled back.
+func (ip *Proxy) AlterRetentionPolicy(db string, rpi *RetentionPolicyInfo) ([]BackendResult, error) {
+	prev := ip.findRetentionPolicy(db, rpi.Name)
+	results := ip.rpFanout(db, rpi.alterStatement(db))
+	if failed := failures(results); len(failed) > 0 {
+		if prev != nil {
+			ip.rollbackAlter(db, prev, results)
+		}
+		return results, fmt.Errorf("alter retention policy failed on %d backend(s)", len(failed))
+	}
+	ip.saveRetentionPolicy(db, rpi)
+	return results, nil
+}
+
+// findRetentionPolicy returns a copy of the persisted policy for name on db.
+func (ip *Proxy) findRetentionPolicy(db, name string) *RetentionPolicyInfo {
+	ip.RLock()
+	defer ip.RUnlock()
+	for _, p := range ip.retentionPolicies[db] {
+		if p.Name == name {
+			cp := *p
+			return &cp
+		}
+	}
+	return nil
+}
+
+// DropRetentionPolicy fans DROP RETENTION POLICY out to every backend. On
+// partial failure it rolls back by re-creating the persisted policy on the
+// backends that succeeded; when no policy named name is persisted for db,
+// nothing is rolled back.
+func (ip *Proxy) DropRetentionPolicy(db, name string) ([]BackendResult, error) {
+	prev := ip.findRetentionPolicy(db, name)
+	results := ip.rpFanout(db, dropStatement(name, db))
+	if failed := failures(results); len(failed) > 0 {
+		if prev != nil {
+			ip.rollbackDrop(db, prev, results)
+		}
+		return results, fmt.Errorf("drop retention policy failed on %d backend(s)", len(failed))
+	}
+	ip.deleteRetentionPolicy(db, name)
+	return results, nil
+}
+
+// rollbackCreate drops rpi from every backend that successfully created it.
+func (ip *Proxy) rollbackCreate(db string, rpi *RetentionPolicyInfo, results []BackendResult) {
+	ip.rollbackTo(db, results, dropStatement(rpi.Name, db))
+}
+
+// rollbackAlter re-applies prev to every backend that applied the failed alter.
+func (ip *Proxy) rollbackAlter(db string, prev *RetentionPolicyInfo, results []BackendResult) {
+	ip.rollbackTo(db, results, prev.alterStatement(db))
+}
+
+// rollbackDrop re-creates prev on every backend that successfully dropped it.
+func (ip *Proxy) rollbackDrop(db string, prev *RetentionPolicyInfo, results []BackendResult) {
+	ip.rollbackTo(db, results, prev.createStatement(db))
+}
+
+// rollbackTo issues stmt to every backend in results that didn't error.
+func (ip *Proxy) rollbackTo(db string, results []BackendResult, stmt string) {
+	backends := ip.allBackends()
+	var wg sync.WaitGroup
+	for i, r := range results {
+		if r.Err != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(be *Backend) {
+			defer wg.Done()
+			be.QueryIQL(db, stmt) // nolint:errcheck
+		}(backends[i])
+	}
+	wg.Wait()
+}
+
+// ListRetentionPolicies returns the last-known, persisted policies for db.
+func (ip *Proxy) ListRetentionPolicies(db string) []*RetentionPolicyInfo {
+	ip.RLock()
+	defer ip.RUnlock()
+	return ip.retentionPolicies[db]
+}
+
+func (ip *Proxy) saveRetentionPolicy(db string, rpi *RetentionPolicyInfo) {
+	ip.Lock()
+	if ip.retentionPolicies == nil {
+		ip.retentionPolicies = make(map[string][]*RetentionPolicyInfo)
+	}
+	policies := ip.retentionPolicies[db]
+	replaced := false
+	for i, p := range policies {
+		if p.Name == rpi.Name {
+			policies[i] = rpi
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		policies = append(policies, rpi)
+	}
+	ip.retentionPolicies[db] = policies
+	ip.Unlock()
+	ip.persistRetentionPolicies() // nolint:errcheck
+}
+
+func (ip *Proxy) deleteRetentionPolicy(db, name string) {
+	ip.Lock()
+	policies := ip.retentionPolicies[db]
+	for i, p := range policies {
+		if p.Name == name {
+			ip.retentionPolicies[db] = append(policies[:i], policies[i+1:]...)
+			break
+		}
+	}
+	ip.Unlock()
+	ip.persistRetentionPolicies() // nolint:errcheck
+}
+
+// persistRetentionPolicies writes the last-known retention policy set to
+// ip.RPFile.
+func (ip *Proxy) persistRetentionPolicies() error {
+	if ip.RPFile == "" {
+		return nil
+	}
+	ip.RLock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(ip.retentionPolicies)
+	ip.RUnlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ip.RPFile, buf.Bytes(), 0644)
+}
+
+// loadRetentionPolicies reads the last-known retention policy set back from
+// ip.RPFile, if present.
+func (ip *Proxy) loadRetentionPolicies() error {
+	if ip.RPFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(ip.RPFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	policies := make(map[string][]*RetentionPolicyInfo)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&policies); err != nil {
+		return err
+	}
+	ip.Lock()
+	ip.retentionPolicies = policies
+	ip.Unlock()
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+)
+
+// precisionV2To1 maps v2 write precisions to their 1.x equivalents.
+var precisionV2To1 = map[string]string{
+	"s":  "s",
+	"ms": "ms",
+	"us": "u",
+	"ns": "ns",
+}
+
+// PrecisionV2To1 translates precision to its 1.x equivalent, defaulting to ns.
+func PrecisionV2To1(precision string) string {
+	if p, ok := precisionV2To1[precision]; ok {
+		return p
+	}
+	return "ns"
+}
+
+// SplitBucket maps a v2 "db/rp" bucket name to its 1.x db/rp pair.
+func SplitBucket(bucket string) (db, rp string) {
+	if i := strings.IndexByte(bucket, '/'); i >= 0 {
+		return bucket[:i], bucket[i+1:]
+	}
+	return bucket, ""
+}
+
+// QueryFlux forwards a Flux query to this backend's own /api/v2/query,
+// authenticating with the backend's own Username/Password.
+func (be *Backend) QueryFlux(ctx context.Context, org, query string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", be.Url+"/api/v2/query", bytes.NewBufferString(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.flux")
+	req.Header.Set("Accept", "text/csv")
+	if be.Username != "" || be.Password != "" {
+		req.SetBasicAuth(be.Username, be.Password)
+	}
+	q := req.URL.Query()
+	q.Set("org", org)
+	req.URL.RawQuery = q.Encode()
+	return http.DefaultClient.Do(req)
+}
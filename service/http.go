@@ -5,26 +5,48 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/pprof"
+	"strings"
+	"time"
 
 	"github.com/chengshiwen/influx-proxy/backend"
+	jwt "github.com/dgrijalva/jwt-go"
 	gzip "github.com/klauspost/pgzip"
 )
 
 type HttpService struct { // nolint:golint
-	ic       *backend.InfluxCluster
-	username string
-	password string
+	ic           *backend.InfluxCluster
+	proxy        *backend.Proxy
+	username     string
+	password     string
+	authSecret   string
+	queryTimeout time.Duration
+	writeTimeout time.Duration
+	v2Tokens     map[string]bool
+}
+
+// SetProxy wires the Proxy backing HandlerCircle's placement lookups.
+func (hs *HttpService) SetProxy(proxy *backend.Proxy) {
+	hs.proxy = proxy
 }
 
 func NewHttpService(ic *backend.InfluxCluster, nodecfg *backend.NodeConfig) (hs *HttpService) { // nolint:golint
 	hs = &HttpService{
-		ic:       ic,
-		username: nodecfg.Username,
-		password: nodecfg.Password,
+		ic:           ic,
+		username:     nodecfg.Username,
+		password:     nodecfg.Password,
+		authSecret:   nodecfg.AuthSharedSecret,
+		queryTimeout: nodecfg.QueryTimeout,
+		writeTimeout: nodecfg.WriteTimeout,
+		v2Tokens:     make(map[string]bool, len(nodecfg.AuthTokens)),
+	}
+	for _, token := range nodecfg.AuthTokens {
+		hs.v2Tokens[token] = true
 	}
 	if hs.ic.DB != "" {
 		log.Print("http database: ", hs.ic.DB)
@@ -32,28 +54,117 @@ func NewHttpService(ic *backend.InfluxCluster, nodecfg *backend.NodeConfig) (hs
 	return
 }
 
-func (hs *HttpService) checkAuth(req *http.Request) bool {
+// requestTimeout returns def, overridden by the request's timeout param.
+func requestTimeout(req *http.Request, def time.Duration) time.Duration {
+	if s := req.FormValue("timeout"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+// withDeadline attaches a deadline to req's context when timeout > 0.
+func withDeadline(req *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	if timeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
+}
+
+// checkAuth tries, in order, JWT bearer auth, u/p query params, then Basic auth.
+func (hs *HttpService) checkAuth(req *http.Request) (string, bool) {
+	if ah := req.Header.Get("Authorization"); strings.HasPrefix(ah, "Bearer ") {
+		username, err := hs.checkBearerAuth(strings.TrimPrefix(ah, "Bearer "))
+		if err != nil {
+			return "", false
+		}
+		return username, true
+	}
 	if hs.username == "" && hs.password == "" {
-		return true
+		return "", true
 	}
 	q := req.URL.Query()
 	if u, p := q.Get("u"), q.Get("p"); u == hs.username && p == hs.password {
-		return true
+		return u, true
 	}
 	if u, p, ok := req.BasicAuth(); ok && u == hs.username && p == hs.password {
-		return true
+		return u, true
+	}
+	return "", false
+}
+
+// checkBearerAuth verifies an HS256/HS512 JWT against authSecret.
+func (hs *HttpService) checkBearerAuth(token string) (string, error) {
+	if hs.authSecret == "" {
+		return "", fmt.Errorf("bearer auth not configured")
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			return []byte(hs.authSecret), nil
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+	})
+	if err != nil {
+		return "", err
 	}
-	return false
+	if _, ok := claims["exp"]; !ok {
+		return "", fmt.Errorf("jwt missing exp claim")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return "", fmt.Errorf("jwt expired")
+	}
+	username, ok := claims["username"].(string)
+	if !ok || username == "" {
+		return "", fmt.Errorf("jwt missing username claim")
+	}
+	return username, nil
 }
 
 func (hs *HttpService) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/ping", hs.HandlerPing)
 	mux.HandleFunc("/query", hs.HandlerQuery)
 	mux.HandleFunc("/write", hs.HandlerWrite)
+	mux.HandleFunc("/circle", hs.HandlerCircle)
+	mux.HandleFunc("/api/v2/write", hs.HandlerV2Write)
+	mux.HandleFunc("/api/v2/query", hs.HandlerV2Query)
+	mux.HandleFunc("/rp", hs.HandlerRP)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 }
 
+// HandlerCircle reports which circle ?db=&meas= would be placed on.
+func (hs *HttpService) HandlerCircle(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkAdminAuth(req) {
+		backend.WriteError(w, req, 401, "authentication failed")
+		return
+	}
+	if hs.proxy == nil {
+		backend.WriteError(w, req, 501, "circle lookup not available")
+		return
+	}
+	db := req.URL.Query().Get("db")
+	meas := req.URL.Query().Get("meas")
+	if db == "" || meas == "" {
+		backend.WriteError(w, req, 400, "db and meas are required")
+		return
+	}
+	key := backend.GetKey(db, meas)
+	circleId := hs.proxy.AssignCircleId(key)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"key":%q,"circle":%q}`, key, circleId)
+}
+
+func (hs *HttpService) checkAdminAuth(req *http.Request) bool {
+	_, ok := hs.checkAuth(req)
+	return ok
+}
+
 func (hs *HttpService) HandlerPing(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	version, _ := hs.ic.Ping()
@@ -65,11 +176,14 @@ func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	w.Header().Add("X-Influxdb-Version", backend.VERSION)
 
-	if !hs.checkAuth(req) {
+	if _, ok := hs.checkAuth(req); !ok {
 		backend.WriteError(w, req, 401, "authentication failed")
 		return
 	}
 
+	req, cancel := withDeadline(req, requestTimeout(req, hs.queryTimeout))
+	defer cancel()
+
 	q := req.FormValue("q")
 	err := hs.ic.Query(w, req)
 	if err != nil {
@@ -85,7 +199,7 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	w.Header().Add("X-Influxdb-Version", backend.VERSION)
 
-	if !hs.checkAuth(req) {
+	if _, ok := hs.checkAuth(req); !ok {
 		backend.WriteError(w, req, 401, "authentication failed")
 		return
 	}
@@ -109,6 +223,9 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	req, cancel := withDeadline(req, requestTimeout(req, hs.writeTimeout))
+	defer cancel()
+
 	body := req.Body
 	if req.Header.Get("Content-Encoding") == "gzip" {
 		b, err := gzip.NewReader(req.Body)
@@ -126,7 +243,7 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = hs.ic.Write(p, precision)
+	err = hs.ic.Write(req.Context(), p, precision)
 	if err == nil {
 		w.WriteHeader(204)
 	}
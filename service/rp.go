@@ -0,0 +1,140 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+)
+
+// rpPayload is the wire format for POST/PUT /rp.
+type rpPayload struct {
+	Name               string `json:"name"`
+	Duration           string `json:"duration"`
+	ShardGroupDuration string `json:"shardGroupDuration"`
+	ReplicaN           int    `json:"replicaN"`
+	Default            bool   `json:"default"`
+}
+
+func (p *rpPayload) toInfo() (*backend.RetentionPolicyInfo, error) {
+	rpi := &backend.RetentionPolicyInfo{Name: p.Name, ReplicaN: p.ReplicaN, Default: p.Default}
+	if p.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if p.ReplicaN <= 0 {
+		return nil, fmt.Errorf("replicaN must be positive")
+	}
+	var err error
+	if rpi.Duration, err = parseRPDuration(p.Duration); err != nil {
+		return nil, fmt.Errorf("invalid duration: %s", err)
+	}
+	if p.ShardGroupDuration != "" {
+		if rpi.ShardGroupDuration, err = parseRPDuration(p.ShardGroupDuration); err != nil {
+			return nil, fmt.Errorf("invalid shardGroupDuration: %s", err)
+		}
+	}
+	return rpi, nil
+}
+
+// parseRPDuration accepts "0" or "INF" for an infinite retention.
+func parseRPDuration(s string) (time.Duration, error) {
+	if s == "" || s == "0" || s == "INF" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration must not be negative")
+	}
+	return d, nil
+}
+
+// HandlerRP implements POST/GET/PUT/DELETE /rp?db=....
+func (hs *HttpService) HandlerRP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	if _, ok := hs.checkAuth(req); !ok {
+		backend.WriteError(w, req, 401, "authentication failed")
+		return
+	}
+	if hs.proxy == nil {
+		backend.WriteError(w, req, 501, "retention policy management not available")
+		return
+	}
+
+	db := req.URL.Query().Get("db")
+	if db == "" {
+		backend.WriteError(w, req, 400, "db is required")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		policies := hs.proxy.ListRetentionPolicies(db)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policies) // nolint:errcheck
+
+	case http.MethodPost, http.MethodPut:
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			backend.WriteError(w, req, 400, err.Error())
+			return
+		}
+		var payload rpPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			backend.WriteError(w, req, 400, "invalid JSON body")
+			return
+		}
+		rpi, err := payload.toInfo()
+		if err != nil {
+			backend.WriteError(w, req, 400, err.Error())
+			return
+		}
+		var results []backend.BackendResult
+		if req.Method == http.MethodPost {
+			results, err = hs.proxy.CreateRetentionPolicy(db, rpi)
+		} else {
+			results, err = hs.proxy.AlterRetentionPolicy(db, rpi)
+		}
+		if err != nil {
+			writeRPResults(w, 500, results, err)
+			return
+		}
+		w.WriteHeader(204)
+
+	case http.MethodDelete:
+		name := req.URL.Query().Get("name")
+		if name == "" {
+			backend.WriteError(w, req, 400, "name is required")
+			return
+		}
+		results, err := hs.proxy.DropRetentionPolicy(db, name)
+		if err != nil {
+			writeRPResults(w, 500, results, err)
+			return
+		}
+		w.WriteHeader(204)
+
+	default:
+		backend.WriteError(w, req, 405, "method not allow")
+	}
+}
+
+// writeRPResults reports the per-backend outcome of a partially failed fan-out.
+func writeRPResults(w http.ResponseWriter, status int, results []backend.BackendResult, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct { // nolint:errcheck
+		Error   string                  `json:"error"`
+		Results []backend.BackendResult `json:"results"`
+	}{Error: err.Error(), Results: results})
+}
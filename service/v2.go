@@ -0,0 +1,166 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	gzip "github.com/klauspost/pgzip"
+)
+
+// v2ErrorEnvelope mirrors InfluxDB 2.x's /api/v2 error shape.
+type v2ErrorEnvelope struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeV2Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v2ErrorEnvelope{Code: code, Message: message}) // nolint:errcheck
+}
+
+// checkV2Auth validates the Authorization: Token <token> header.
+func (hs *HttpService) checkV2Auth(req *http.Request) bool {
+	if len(hs.v2Tokens) == 0 {
+		return true
+	}
+	ah := req.Header.Get("Authorization")
+	if !strings.HasPrefix(ah, "Token ") {
+		return false
+	}
+	return hs.v2Tokens[strings.TrimPrefix(ah, "Token ")]
+}
+
+// HandlerV2Write implements InfluxDB 2.x's POST /api/v2/write.
+func (hs *HttpService) HandlerV2Write(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	if !hs.checkV2Auth(req) {
+		writeV2Error(w, 401, "unauthorized", "authentication failed")
+		return
+	}
+	if req.Method != "POST" {
+		writeV2Error(w, 405, "method not allowed", "method not allow")
+		return
+	}
+
+	q := req.URL.Query()
+	bucket := q.Get("bucket")
+	if bucket == "" {
+		writeV2Error(w, 400, "invalid", "bucket is required")
+		return
+	}
+	db, _ := backend.SplitBucket(bucket)
+	if hs.ic.DB != "" && db != hs.ic.DB {
+		writeV2Error(w, 400, "invalid", "bucket forbidden")
+		return
+	}
+	precision := backend.PrecisionV2To1(q.Get("precision"))
+
+	req, cancel := withDeadline(req, requestTimeout(req, hs.writeTimeout))
+	defer cancel()
+
+	body := req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		b, err := gzip.NewReader(req.Body)
+		if err != nil {
+			writeV2Error(w, 400, "invalid", "unable to decode gzip body")
+			return
+		}
+		defer b.Close()
+		body = b
+	}
+
+	p, err := ioutil.ReadAll(body)
+	if err != nil {
+		writeV2Error(w, 400, "invalid", err.Error())
+		return
+	}
+
+	if err := hs.ic.Write(req.Context(), p, precision); err != nil {
+		writeV2Error(w, 500, "internal error", err.Error())
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// v2QueryRequest is the JSON body accepted by /api/v2/query.
+type v2QueryRequest struct {
+	Query string `json:"query"`
+}
+
+// HandlerV2Query implements InfluxDB 2.x's POST /api/v2/query.
+func (hs *HttpService) HandlerV2Query(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	if !hs.checkV2Auth(req) {
+		writeV2Error(w, 401, "unauthorized", "authentication failed")
+		return
+	}
+	if hs.proxy == nil {
+		writeV2Error(w, 501, "not implemented", "flux query routing not available")
+		return
+	}
+
+	q := req.URL.Query()
+	org := q.Get("org")
+	bucket := q.Get("bucket")
+	if bucket == "" {
+		writeV2Error(w, 400, "invalid", "bucket is required")
+		return
+	}
+	db, _ := backend.SplitBucket(bucket)
+	if hs.ic.DB != "" && db != hs.ic.DB {
+		writeV2Error(w, 400, "invalid", "bucket forbidden")
+		return
+	}
+
+	raw, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeV2Error(w, 400, "invalid", err.Error())
+		return
+	}
+
+	var flux string
+	if ct := req.Header.Get("Content-Type"); strings.HasPrefix(ct, "application/vnd.flux") {
+		flux = string(raw)
+	} else {
+		var qr v2QueryRequest
+		if err := json.Unmarshal(raw, &qr); err != nil {
+			writeV2Error(w, 400, "invalid", "unable to parse query body")
+			return
+		}
+		flux = qr.Query
+	}
+	if strings.TrimSpace(flux) == "" {
+		writeV2Error(w, 400, "invalid", "query is required")
+		return
+	}
+
+	req, cancel := withDeadline(req, requestTimeout(req, hs.queryTimeout))
+	defer cancel()
+
+	key := backend.GetKey(db, "")
+	circle := hs.proxy.AssignCircle(key)
+	be := circle.GetBackend(key)
+
+	resp, err := be.QueryFlux(req.Context(), org, flux)
+	if err != nil {
+		writeV2Error(w, 502, "internal error", fmt.Sprintf("backend query failed: %s", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body) // nolint:errcheck
+}